@@ -0,0 +1,158 @@
+package pdu
+
+// Streaming helpers for P-DATA-TF (P3.8 9.3.5): PDataTfWriter fragments a
+// command or data stream into PresentationDataValueItems sized to the
+// peer's negotiated maximum PDU length, and PDataTfReader does the
+// reverse, so neither side needs to hold an entire multi-frame dataset in
+// memory at once.
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/grailbio/go-dicom/dicomio"
+)
+
+// pdvHeaderSize is the size, in bytes, of a PresentationDataValueItem's
+// length+contextID+message-header fields, i.e. everything but Value.
+const pdvHeaderSize = 6
+
+// defaultMaxFragmentSize is the PDV payload size used when the peer's
+// UserInformationMaximumLengthItem.MaximumLengthReceived is 0 ("no limit").
+const defaultMaxFragmentSize = 16372
+
+// PDataTfWriter streams DIMSE command or data bytes to the peer as a
+// sequence of P-DATA-TF PDUs. It fragments the stream into
+// PresentationDataValueItems no larger than the peer's negotiated maximum
+// PDU length, writing each fragment to the underlying connection as soon
+// as it fills, so a large C-STORE dataset is never buffered in full.
+type PDataTfWriter struct {
+	w               io.Writer
+	contextID       byte
+	maxFragmentSize int
+}
+
+// NewPDataTfWriter returns a PDataTfWriter that writes P-DATA-TF PDUs to w
+// for the presentation context contextID. maximumLengthReceived is the
+// peer's UserInformationMaximumLengthItem.MaximumLengthReceived; 0 means
+// the peer advertised no limit.
+func NewPDataTfWriter(w io.Writer, contextID byte, maximumLengthReceived uint32) *PDataTfWriter {
+	maxFragmentSize := int(maximumLengthReceived) - pduHeaderSize - pdvHeaderSize
+	if maximumLengthReceived == 0 || maxFragmentSize <= 0 {
+		maxFragmentSize = defaultMaxFragmentSize
+	}
+	return &PDataTfWriter{w: w, contextID: contextID, maxFragmentSize: maxFragmentSize}
+}
+
+// WriteCommand streams the DIMSE command bytes read from r as one or more
+// P-DATA-TF PDUs, marking the last fragment's Command/Last bits as P3.8
+// E.2 requires.
+func (pw *PDataTfWriter) WriteCommand(r io.Reader) error {
+	return pw.write(r, true /*command*/)
+}
+
+// WriteData streams the DIMSE data-set bytes read from r as one or more
+// P-DATA-TF PDUs.
+func (pw *PDataTfWriter) WriteData(r io.Reader) error {
+	return pw.write(r, false /*command*/)
+}
+
+func (pw *PDataTfWriter) write(r io.Reader, command bool) error {
+	buf := make([]byte, pw.maxFragmentSize)
+	// pushback holds a byte already pulled from r while probing for more
+	// input, to be prepended to the next fragment instead of read twice.
+	var pushback [1]byte
+	havePushback := false
+	for {
+		n := 0
+		if havePushback {
+			buf[0] = pushback[0]
+			n = 1
+			havePushback = false
+		}
+		readN, err := io.ReadFull(r, buf[n:])
+		n += readN
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		// Probe for one more byte so a fragment that exactly fills buf isn't
+		// mistaken for the last one, and so an exhausted reader doesn't cost
+		// an extra, empty, Last-only fragment.
+		pn, perr := io.ReadFull(r, pushback[:])
+		if pn == 1 {
+			havePushback = true
+		} else if perr != io.EOF {
+			return perr
+		}
+		last := pn == 0
+		if werr := pw.writeFragment(buf[:n], command, last); werr != nil {
+			return werr
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+func (pw *PDataTfWriter) writeFragment(value []byte, command, last bool) error {
+	item := PresentationDataValueItem{
+		ContextID: pw.contextID,
+		Command:   command,
+		Last:      last,
+		Value:     append([]byte(nil), value...),
+	}
+	e := dicomio.NewBytesEncoder(binary.BigEndian, dicomio.UnknownVR)
+	item.Write(e)
+	if err := e.Error(); err != nil {
+		return err
+	}
+	payload := e.Bytes()
+	var header [pduHeaderSize]byte
+	header[0] = byte(TypePDataTf)
+	binary.BigEndian.PutUint32(header[2:6], uint32(len(payload)))
+	if _, err := pw.w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err := pw.w.Write(payload)
+	return err
+}
+
+// PDataTfReader reconstructs a DIMSE command or data-set byte stream from
+// PresentationDataValueItems supplied by nextItem, letting callers read it
+// via the io.Reader interface instead of concatenating fragments by hand.
+type PDataTfReader struct {
+	nextItem func() (PresentationDataValueItem, error)
+	command  bool
+	pending  []byte
+	done     bool
+}
+
+// NewPDataTfReader returns a PDataTfReader over the command (if command is
+// true) or data fragments produced by nextItem, which the caller typically
+// implements by pulling PresentationDataValueItems out of incoming
+// P-DATA-TF PDUs as they arrive.
+func NewPDataTfReader(command bool, nextItem func() (PresentationDataValueItem, error)) *PDataTfReader {
+	return &PDataTfReader{nextItem: nextItem, command: command}
+}
+
+// Read implements io.Reader, returning io.EOF once the fragment with
+// Last=true for this reader's message type has been consumed.
+func (pr *PDataTfReader) Read(p []byte) (int, error) {
+	for len(pr.pending) == 0 {
+		if pr.done {
+			return 0, io.EOF
+		}
+		item, err := pr.nextItem()
+		if err != nil {
+			return 0, err
+		}
+		if item.Command != pr.command {
+			return 0, fmt.Errorf("PDataTfReader: got %v, want a fragment with command=%v", item, pr.command)
+		}
+		pr.pending = item.Value
+		pr.done = item.Last
+	}
+	n := copy(p, pr.pending)
+	pr.pending = pr.pending[n:]
+	return n, nil
+}
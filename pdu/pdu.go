@@ -21,6 +21,10 @@ import (
 
 const CurrentProtocolVersion uint16 = 1
 
+// pduHeaderSize is the size, in bytes, of the Upper Layer PDU header: a
+// 1-byte type, a reserved byte, and a 4-byte payload length. P3.8 9.3.
+const pduHeaderSize = 6
+
 // PDU is the interface for DUL messages like A-ASSOCIATE-AC, P-DATA-TF.
 type PDU interface {
 	fmt.Stringer
@@ -52,17 +56,21 @@ type SubItem interface {
 
 // Possible Type field values for SubItem.
 const (
-	ItemTypeApplicationContext           = 0x10
-	ItemTypePresentationContextRequest   = 0x20
-	ItemTypePresentationContextResponse  = 0x21
-	ItemTypeAbstractSyntax               = 0x30
-	ItemTypeTransferSyntax               = 0x40
-	ItemTypeUserInformation              = 0x50
-	ItemTypeUserInformationMaximumLength = 0x51
-	ItemTypeImplementationClassUID       = 0x52
-	ItemTypeAsynchronousOperationsWindow = 0x53
-	ItemTypeRoleSelection                = 0x54
-	ItemTypeImplementationVersionName    = 0x55
+	ItemTypeApplicationContext                = 0x10
+	ItemTypePresentationContextRequest        = 0x20
+	ItemTypePresentationContextResponse       = 0x21
+	ItemTypeAbstractSyntax                    = 0x30
+	ItemTypeTransferSyntax                    = 0x40
+	ItemTypeUserInformation                   = 0x50
+	ItemTypeUserInformationMaximumLength      = 0x51
+	ItemTypeImplementationClassUID            = 0x52
+	ItemTypeAsynchronousOperationsWindow      = 0x53
+	ItemTypeRoleSelection                     = 0x54
+	ItemTypeImplementationVersionName         = 0x55
+	ItemTypeSOPClassExtendedNegotiation       = 0x56
+	ItemTypeSOPClassCommonExtendedNegotiation = 0x57
+	ItemTypeUserIdentityNegotiation           = 0x58
+	ItemTypeUserIdentityNegotiationResponse   = 0x59
 )
 
 func decodeSubItem(d *dicomio.Decoder) SubItem {
@@ -92,6 +100,14 @@ func decodeSubItem(d *dicomio.Decoder) SubItem {
 		return decodeRoleSelectionSubItem(d, length)
 	case ItemTypeImplementationVersionName:
 		return decodeImplementationVersionNameSubItem(d, length)
+	case ItemTypeSOPClassExtendedNegotiation:
+		return decodeSOPClassExtendedNegotiationSubItem(d, length)
+	case ItemTypeSOPClassCommonExtendedNegotiation:
+		return decodeSOPClassCommonExtendedNegotiationSubItem(d, length)
+	case ItemTypeUserIdentityNegotiation:
+		return decodeUserIdentityNegotiationSubItem(d, length)
+	case ItemTypeUserIdentityNegotiationResponse:
+		return decodeUserIdentityNegotiationAcSubItem(d, length)
 	default:
 		d.SetError(fmt.Errorf("Unknown item type: 0x%x", itemType))
 		return nil
@@ -142,6 +158,56 @@ func (v *UserInformationItem) String() string {
 		subItemListString(v.Items))
 }
 
+// UserIdentityNegotiations returns the UserIdentityNegotiationSubItems
+// carried in this UserInformationItem, so an acceptor can require and
+// validate credentials on A-ASSOCIATE-RQ.
+func (v *UserInformationItem) UserIdentityNegotiations() []*UserIdentityNegotiationSubItem {
+	var items []*UserIdentityNegotiationSubItem
+	for _, s := range v.Items {
+		if item, ok := s.(*UserIdentityNegotiationSubItem); ok {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// UserIdentityNegotiationResponse returns the UserIdentityNegotiationAcSubItem
+// carried in this UserInformationItem, or nil if the peer didn't send one.
+func (v *UserInformationItem) UserIdentityNegotiationResponse() *UserIdentityNegotiationAcSubItem {
+	for _, s := range v.Items {
+		if item, ok := s.(*UserIdentityNegotiationAcSubItem); ok {
+			return item
+		}
+	}
+	return nil
+}
+
+// SOPClassExtendedNegotiations returns the SOPClassExtendedNegotiationSubItems
+// carried in this UserInformationItem, so the DIMSE layer can apply any
+// negotiated service class options per presentation context.
+func (v *UserInformationItem) SOPClassExtendedNegotiations() []*SOPClassExtendedNegotiationSubItem {
+	var items []*SOPClassExtendedNegotiationSubItem
+	for _, s := range v.Items {
+		if item, ok := s.(*SOPClassExtendedNegotiationSubItem); ok {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// SOPClassCommonExtendedNegotiations returns the
+// SOPClassCommonExtendedNegotiationSubItems carried in this
+// UserInformationItem.
+func (v *UserInformationItem) SOPClassCommonExtendedNegotiations() []*SOPClassCommonExtendedNegotiationSubItem {
+	var items []*SOPClassCommonExtendedNegotiationSubItem
+	for _, s := range v.Items {
+		if item, ok := s.(*SOPClassCommonExtendedNegotiationSubItem); ok {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
 // P3.8 D.1
 type UserInformationMaximumLengthItem struct {
 	MaximumLengthReceived uint32
@@ -246,6 +312,183 @@ func (v *ImplementationVersionNameSubItem) String() string {
 	return fmt.Sprintf("ImplementationVersionName{name: \"%s\"}", v.Name)
 }
 
+// PS3.7 Annex D.3.3.5.1
+type SOPClassExtendedNegotiationSubItem struct {
+	SOPClassUID                        string
+	ServiceClassApplicationInformation []byte
+}
+
+func decodeSOPClassExtendedNegotiationSubItem(d *dicomio.Decoder, length uint16) *SOPClassExtendedNegotiationSubItem {
+	d.PushLimit(int64(length))
+	defer d.PopLimit()
+	uidLen := d.ReadUInt16()
+	v := &SOPClassExtendedNegotiationSubItem{SOPClassUID: d.ReadString(int(uidLen))}
+	remaining := int(length) - 2 - int(uidLen)
+	if remaining < 0 {
+		d.SetError(fmt.Errorf("SOPClassExtendedNegotiationSubItem: SOP class UID length %d exceeds item length %d", uidLen, length))
+		return v
+	}
+	v.ServiceClassApplicationInformation = d.ReadBytes(remaining)
+	return v
+}
+
+func (v *SOPClassExtendedNegotiationSubItem) Write(e *dicomio.Encoder) {
+	encodeSubItemHeader(e, ItemTypeSOPClassExtendedNegotiation,
+		uint16(2+len(v.SOPClassUID)+len(v.ServiceClassApplicationInformation)))
+	e.WriteUInt16(uint16(len(v.SOPClassUID)))
+	e.WriteString(v.SOPClassUID)
+	e.WriteBytes(v.ServiceClassApplicationInformation)
+}
+
+func (v *SOPClassExtendedNegotiationSubItem) String() string {
+	return fmt.Sprintf("SOPClassExtendedNegotiation{sopclassuid: %v, serviceClassApplicationInformation: %dbytes}",
+		v.SOPClassUID, len(v.ServiceClassApplicationInformation))
+}
+
+// PS3.7 Annex D.3.3.6.1
+type SOPClassCommonExtendedNegotiationSubItem struct {
+	SubItemVersion             byte
+	SOPClassUID                string
+	ServiceClassUID            string
+	RelatedGeneralSOPClassUIDs []string
+}
+
+func decodeSOPClassCommonExtendedNegotiationSubItem(d *dicomio.Decoder, length uint16) *SOPClassCommonExtendedNegotiationSubItem {
+	v := &SOPClassCommonExtendedNegotiationSubItem{}
+	d.PushLimit(int64(length))
+	defer d.PopLimit()
+	v.SubItemVersion = d.ReadByte()
+	sopClassUIDLen := d.ReadUInt16()
+	v.SOPClassUID = d.ReadString(int(sopClassUIDLen))
+	serviceClassUIDLen := d.ReadUInt16()
+	v.ServiceClassUID = d.ReadString(int(serviceClassUIDLen))
+	relatedLen := d.ReadUInt16()
+	d.PushLimit(int64(relatedLen))
+	for !d.EOF() {
+		uidLen := d.ReadUInt16()
+		v.RelatedGeneralSOPClassUIDs = append(v.RelatedGeneralSOPClassUIDs, d.ReadString(int(uidLen)))
+	}
+	d.PopLimit()
+	// Remaining bytes are reserved for future, implementation-specific use.
+	return v
+}
+
+func (v *SOPClassCommonExtendedNegotiationSubItem) Write(e *dicomio.Encoder) {
+	relatedEncoder := dicomio.NewBytesEncoder(binary.BigEndian, dicomio.UnknownVR)
+	for _, uid := range v.RelatedGeneralSOPClassUIDs {
+		relatedEncoder.WriteUInt16(uint16(len(uid)))
+		relatedEncoder.WriteString(uid)
+	}
+	relatedBytes := relatedEncoder.Bytes()
+	length := 1 + 2 + len(v.SOPClassUID) + 2 + len(v.ServiceClassUID) + 2 + len(relatedBytes)
+	encodeSubItemHeader(e, ItemTypeSOPClassCommonExtendedNegotiation, uint16(length))
+	e.WriteByte(v.SubItemVersion)
+	e.WriteUInt16(uint16(len(v.SOPClassUID)))
+	e.WriteString(v.SOPClassUID)
+	e.WriteUInt16(uint16(len(v.ServiceClassUID)))
+	e.WriteString(v.ServiceClassUID)
+	e.WriteUInt16(uint16(len(relatedBytes)))
+	e.WriteBytes(relatedBytes)
+}
+
+func (v *SOPClassCommonExtendedNegotiationSubItem) String() string {
+	return fmt.Sprintf("SOPClassCommonExtendedNegotiation{sopclassuid: %v, serviceclassuid: %v, relatedGeneralSOPClassUIDs: %v}",
+		v.SOPClassUID, v.ServiceClassUID, v.RelatedGeneralSOPClassUIDs)
+}
+
+// Possible values for UserIdentityNegotiationSubItem.UserIdentityType. PS3.7
+// Annex D.3.3.7.1.
+const (
+	UserIdentityTypeUsername              = 1
+	UserIdentityTypeUsernamePasscode      = 2
+	UserIdentityTypeKerberosServiceTicket = 3
+	UserIdentityTypeSAMLAssertion         = 4
+	UserIdentityTypeJWT                   = 5
+)
+
+// PS3.7 Annex D.3.3.7.1
+type UserIdentityNegotiationSubItem struct {
+	UserIdentityType          byte
+	PositiveResponseRequested bool
+	PrimaryField              []byte
+	SecondaryField            []byte
+}
+
+func decodeUserIdentityNegotiationSubItem(d *dicomio.Decoder, length uint16) *UserIdentityNegotiationSubItem {
+	d.PushLimit(int64(length))
+	defer d.PopLimit()
+	v := &UserIdentityNegotiationSubItem{}
+	v.UserIdentityType = d.ReadByte()
+	v.PositiveResponseRequested = d.ReadByte() != 0
+	primaryLen := d.ReadUInt16()
+	remaining := int(length) - 4
+	if int(primaryLen) > remaining {
+		d.SetError(fmt.Errorf("UserIdentityNegotiationSubItem: primary field length %d exceeds item length %d", primaryLen, length))
+		return v
+	}
+	v.PrimaryField = d.ReadBytes(int(primaryLen))
+	remaining -= int(primaryLen)
+	if remaining < 2 {
+		d.SetError(fmt.Errorf("UserIdentityNegotiationSubItem: item length %d too short for a secondary field length", length))
+		return v
+	}
+	secondaryLen := d.ReadUInt16()
+	remaining -= 2
+	if int(secondaryLen) > remaining {
+		d.SetError(fmt.Errorf("UserIdentityNegotiationSubItem: secondary field length %d exceeds item length %d", secondaryLen, length))
+		return v
+	}
+	v.SecondaryField = d.ReadBytes(int(secondaryLen))
+	return v
+}
+
+func (v *UserIdentityNegotiationSubItem) Write(e *dicomio.Encoder) {
+	length := 1 + 1 + 2 + len(v.PrimaryField) + 2 + len(v.SecondaryField)
+	encodeSubItemHeader(e, ItemTypeUserIdentityNegotiation, uint16(length))
+	e.WriteByte(v.UserIdentityType)
+	if v.PositiveResponseRequested {
+		e.WriteByte(1)
+	} else {
+		e.WriteByte(0)
+	}
+	e.WriteUInt16(uint16(len(v.PrimaryField)))
+	e.WriteBytes(v.PrimaryField)
+	e.WriteUInt16(uint16(len(v.SecondaryField)))
+	e.WriteBytes(v.SecondaryField)
+}
+
+func (v *UserIdentityNegotiationSubItem) String() string {
+	return fmt.Sprintf("UserIdentityNegotiation{type: %d, positiveResponseRequested: %v, primary: %dbytes, secondary: %dbytes}",
+		v.UserIdentityType, v.PositiveResponseRequested, len(v.PrimaryField), len(v.SecondaryField))
+}
+
+// PS3.7 Annex D.3.3.7.2
+type UserIdentityNegotiationAcSubItem struct {
+	ServerResponse []byte
+}
+
+func decodeUserIdentityNegotiationAcSubItem(d *dicomio.Decoder, length uint16) *UserIdentityNegotiationAcSubItem {
+	d.PushLimit(int64(length))
+	defer d.PopLimit()
+	responseLen := d.ReadUInt16()
+	remaining := int(length) - 2
+	if int(responseLen) > remaining {
+		d.SetError(fmt.Errorf("UserIdentityNegotiationAcSubItem: server response length %d exceeds item length %d", responseLen, length))
+		return &UserIdentityNegotiationAcSubItem{}
+	}
+	return &UserIdentityNegotiationAcSubItem{ServerResponse: d.ReadBytes(int(responseLen))}
+}
+
+func (v *UserIdentityNegotiationAcSubItem) Write(e *dicomio.Encoder) {
+	encodeSubItemHeader(e, ItemTypeUserIdentityNegotiationResponse, uint16(2+len(v.ServerResponse)))
+	e.WriteUInt16(uint16(len(v.ServerResponse)))
+	e.WriteBytes(v.ServerResponse)
+}
+
+func (v *UserIdentityNegotiationAcSubItem) String() string {
+	return fmt.Sprintf("UserIdentityNegotiationAc{serverResponse: %dbytes}", len(v.ServerResponse))
+}
+
 // Container for subitems that this package doesnt' support
 type SubItemUnsupported struct {
 	Type byte
@@ -441,37 +684,58 @@ func (v *PresentationDataValueItem) String() string {
 	return fmt.Sprintf("PresentationDataValue{context: %d, cmd:%v last:%v value: %d bytes}", v.ContextID, v.Command, v.Last, len(v.Value))
 }
 
-// EncodePDU serializes "pdu" into []byte.
-func EncodePDU(pdu PDU) ([]byte, error) {
-	var pduType Type
+// pduTypeOf returns the wire Type tag for pdu, panicking on a PDU
+// implementation this package doesn't know about.
+func pduTypeOf(pdu PDU) Type {
 	switch pdu.(type) {
 	case *AAssociateRQ:
-		pduType = TypeAAssociateRq
+		return TypeAAssociateRq
 	case *AAssociateAC:
-		pduType = TypeAAssociateAc
+		return TypeAAssociateAc
 	case *AAssociateRj:
-		pduType = TypeAAssociateRj
+		return TypeAAssociateRj
 	case *PDataTf:
-		pduType = TypePDataTf
+		return TypePDataTf
 	case *AReleaseRq:
-		pduType = TypeAReleaseRq
+		return TypeAReleaseRq
 	case *AReleaseRp:
-		pduType = TypeAReleaseRp
+		return TypeAReleaseRp
 	case *AAbort:
-		pduType = TypeAAbort
+		return TypeAAbort
 	default:
 		panic(fmt.Sprintf("Unknown PDU %v", pdu))
 	}
+}
+
+// EncodePDUTo writes pdu's 6-byte header followed by its payload to w. The
+// payload is written to w directly instead of being concatenated onto the
+// header in a freshly allocated slice, but it is still built in full by
+// pdu.Write() before anything is written. PDataTfWriter does not go through
+// this function; it writes its P-DATA-TF PDUs itself.
+func EncodePDUTo(w io.Writer, pdu PDU) error {
+	pduType := pduTypeOf(pdu)
 	payload, err := pdu.Write()
 	if err != nil {
-		return nil, err
+		return err
 	}
-	// Reserve the header bytes. It will be filled in Finish.
-	var header [6]byte // First 6 bytes of buf.
+	var header [pduHeaderSize]byte
 	header[0] = byte(pduType)
 	header[1] = 0 // Reserved.
 	binary.BigEndian.PutUint32(header[2:6], uint32(len(payload)))
-	return append(header[:], payload...), nil
+	if _, err := w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err = w.Write(payload)
+	return err
+}
+
+// EncodePDU serializes "pdu" into []byte.
+func EncodePDU(pdu PDU) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := EncodePDUTo(&buf, pdu); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
 }
 
 // EncodePDU reads a "pdu" from a stream. maxPDUSize defines the maximum
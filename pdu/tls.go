@@ -0,0 +1,214 @@
+package pdu
+
+// TLS-secured Upper Layer transport, per the security profiles defined in
+// PS3.15 Annex B. SecureDialer/SecureListener wrap a plain TCP
+// net.Conn/net.Listener with crypto/tls and verify that the peer's
+// certificate identifies the AE Title named in the A-ASSOCIATE-RQ, so
+// cross-enterprise associations can be authenticated at the transport
+// layer rather than trusting whatever IP address connected.
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+)
+
+// TLSProfile pins the TLS versions and cipher suites allowed for an
+// association, matching one of the security profiles in PS3.15 Annex B.
+type TLSProfile struct {
+	Name         string
+	MinVersion   uint16
+	MaxVersion   uint16
+	CipherSuites []uint16
+}
+
+// ProfileBCP195 is the BCP 195 TLS Profile (PS3.15 B.2): TLS 1.2 or later
+// restricted to the cipher suites BCP 195 recommends.
+var ProfileBCP195 = TLSProfile{
+	Name:       "BCP 195",
+	MinVersion: tls.VersionTLS12,
+	CipherSuites: []uint16{
+		tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+		tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	},
+}
+
+// ProfileBasicAES is the Basic TLS Secure Transport Connection Profile
+// (PS3.15 B.1), restricted to AES cipher suites for deployments that still
+// require it.
+var ProfileBasicAES = TLSProfile{
+	Name:       "Basic AES",
+	MinVersion: tls.VersionTLS12,
+	CipherSuites: []uint16{
+		tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+		tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+	},
+}
+
+// configure returns a copy of base with p's version and cipher suite
+// restrictions applied.
+func (p TLSProfile) configure(base *tls.Config) *tls.Config {
+	var cfg *tls.Config
+	if base != nil {
+		cfg = base.Clone()
+	} else {
+		cfg = &tls.Config{}
+	}
+	cfg.MinVersion = p.MinVersion
+	if p.MaxVersion != 0 {
+		cfg.MaxVersion = p.MaxVersion
+	}
+	if len(p.CipherSuites) > 0 {
+		cfg.CipherSuites = p.CipherSuites
+	}
+	return cfg
+}
+
+// TLSHandshakeError reports that establishing or validating a TLS-secured
+// association failed, along with the A-ASSOCIATE-RJ fields the caller
+// should reject the association with, so the DICOM-level logs show why
+// the association was refused instead of just a closed TCP connection.
+type TLSHandshakeError struct {
+	Result RejectResultType
+	Source SourceType
+	Reason RejectReasonType
+	Err    error
+}
+
+func (e *TLSHandshakeError) Error() string {
+	return fmt.Sprintf("pdu: TLS-secured association failed: %v", e.Err)
+}
+
+func (e *TLSHandshakeError) Unwrap() error { return e.Err }
+
+// AssociateRj builds the A-ASSOCIATE-RJ PDU carrying e's Result, Source and
+// Reason. It can only be sent over a connection that is still open, as after
+// an error from VerifyCallingAETitle: SecureDialer.Dial and
+// SecureListener.Accept close the connection before returning their errors.
+func (e *TLSHandshakeError) AssociateRj() *AAssociateRj {
+	return &AAssociateRj{Result: e.Result, Source: e.Source, Reason: e.Reason}
+}
+
+// SecureDialer dials a DICOM Upper Layer connection secured per profile,
+// then checks that the peer's certificate identifies CalledAETitle before
+// handing the connection back to the caller.
+type SecureDialer struct {
+	Profile       TLSProfile
+	TLSConfig     *tls.Config
+	CalledAETitle string // If set, must match the peer certificate's AE Title.
+}
+
+// Dial connects to addr over TLS and verifies the peer's AE Title.
+func (d *SecureDialer) Dial(network, addr string) (net.Conn, error) {
+	cfg := d.Profile.configure(d.TLSConfig)
+	conn, err := tls.Dial(network, addr, cfg)
+	if err != nil {
+		return nil, &TLSHandshakeError{
+			Result: ResultRejectedPermanent,
+			Source: SourceULServiceProviderACSE,
+			Reason: RejectReasonNone,
+			Err:    err,
+		}
+	}
+	if d.CalledAETitle != "" {
+		if err := verifyPeerAETitle(conn, d.CalledAETitle, RejectReasonCalledAETitleNotRecognized); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// SecureListener accepts DICOM Upper Layer connections secured per
+// profile. Accept only completes the TLS handshake: PS3.8's acceptor
+// state machine has no transition to reject an association before it has
+// read the peer's A-ASSOCIATE-RQ, so verifying the Calling AE Title
+// against that PDU's contents happens afterwards, via
+// VerifyCallingAETitle.
+type SecureListener struct {
+	net.Listener
+	Profile TLSProfile
+}
+
+// NewSecureListener wraps inner with TLS secured per profile.
+func NewSecureListener(inner net.Listener, profile TLSProfile, tlsConfig *tls.Config) *SecureListener {
+	return &SecureListener{Listener: tls.NewListener(inner, profile.configure(tlsConfig)), Profile: profile}
+}
+
+// Accept waits for the next incoming connection and completes its TLS
+// handshake. The peer's certificate is available via the returned
+// *tls.Conn's ConnectionState once the acceptor has read the
+// A-ASSOCIATE-RQ and knows which Calling AE Title to check it against.
+func (l *SecureListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return conn, nil
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		// No secure channel was ever established, so there's no way to
+		// deliver an A-ASSOCIATE-RJ PDU to the peer; a TCP close is all we
+		// can do here.
+		tlsConn.Close()
+		return nil, &TLSHandshakeError{
+			Result: ResultRejectedPermanent,
+			Source: SourceULServiceProviderACSE,
+			Reason: RejectReasonNone,
+			Err:    err,
+		}
+	}
+	return tlsConn, nil
+}
+
+// VerifyCallingAETitle checks that conn's peer certificate identifies
+// callingAETitle, the Calling AE Title the acceptor just read from the
+// A-ASSOCIATE-RQ PDU it received over conn. On mismatch it returns a
+// *TLSHandshakeError; the caller should write its AssociateRj() PDU (e.g.
+// via EncodePDUTo) in place of the A-ASSOCIATE-AC it would otherwise have
+// sent, then close conn. Calling this before the A-ASSOCIATE-RQ has been
+// read is a protocol violation: the peer isn't expecting any PDU yet.
+func VerifyCallingAETitle(conn *tls.Conn, callingAETitle string) error {
+	return verifyPeerAETitle(conn, callingAETitle, RejectReasonCallingAETitleNotRecognized)
+}
+
+// peerAETitle extracts the AE Title a peer certificate claims, matching it
+// against the certificate's subject CN, falling back to its first SAN.
+func peerAETitle(conn *tls.Conn) (string, error) {
+	state := conn.ConnectionState()
+	if len(state.PeerCertificates) == 0 {
+		return "", fmt.Errorf("pdu: peer presented no certificate")
+	}
+	cert := state.PeerCertificates[0]
+	if cert.Subject.CommonName != "" {
+		return cert.Subject.CommonName, nil
+	}
+	if len(cert.DNSNames) > 0 {
+		return cert.DNSNames[0], nil
+	}
+	return "", fmt.Errorf("pdu: peer certificate has no CN or SAN to match against an AE Title")
+}
+
+func verifyPeerAETitle(conn *tls.Conn, wantAETitle string, reason RejectReasonType) error {
+	aeTitle, err := peerAETitle(conn)
+	if err != nil {
+		return &TLSHandshakeError{
+			Result: ResultRejectedPermanent,
+			Source: SourceULServiceProviderACSE,
+			Reason: reason,
+			Err:    err,
+		}
+	}
+	if aeTitle != wantAETitle {
+		return &TLSHandshakeError{
+			Result: ResultRejectedPermanent,
+			Source: SourceULServiceProviderACSE,
+			Reason: reason,
+			Err:    fmt.Errorf("pdu: peer AE Title %q does not match expected AE Title %q", aeTitle, wantAETitle),
+		}
+	}
+	return nil
+}